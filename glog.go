@@ -4,7 +4,7 @@
 
 // Package glog implements a simple level logging package based on golang's
 // standard log and glog package. It has fully compatible interface to standard
-// log package. It defines a type, Logger, with methods for formatting output. 
+// log package. It defines a type, Logger, with methods for formatting output.
 // Basic examples:
 //
 //	options := glog.LogOptions{
@@ -21,16 +21,16 @@
 //	logger.Infof("hello, %s", "chasex")
 //	logger.Warn("testing message")
 //	logger.Flush()
-// 
+//
 // The output contents in abc.log will be:
-// 
+//
 //	2016/02/16 17:50:07 DEBUG hello world
 //	2016/02/16 17:50:07 INFO hello, chasex
 //	2016/02/16 17:50:07 INFO testing message
-// 
+//
 // It also support rotating log file by size, hour or day.
 // According to rotate mode, log file name has distinct suffix:
-// 
+//
 //	R_None: no suffix, abc.log.
 //	R_Size: suffix with date and clock, abc.log-YYYYMMDD-HHMMSS.
 //	R_Hour: suffix with date and hour, abc.log-YYYYMMDD-HH.
@@ -39,15 +39,53 @@
 // Note that it has a daemon routine flushing buffered data to underlying file
 // periodically (default every 30s). When exit, remember calling Flush() manually,
 // otherwise it may cause some date loss.
+//
+// glog also supports klog-style verbosity logging through V, for debug output
+// that should only be emitted above a configurable verbosity level:
+//
+//	logger.SetVerbosity(2)
+//	logger.SetVModule("worker=3")
+//	logger.V(2).Infof("connected to %s", addr)
+//
+// For log-aggregation pipelines that expect structured records, With attaches
+// key/value context to a Logger and Debugw/Infow/Warnw/Errorw emit it as JSON
+// or logfmt, depending on LogOptions.Encoder:
+//
+//	reqLogger := logger.With("request_id", reqID)
+//	reqLogger.Infow("request handled", "status", 200, "duration", dur)
+//
+// A Logger can fan a record out to more than one Sink. New always sets up
+// the rotating file sink described by LogOptions; additional sinks, each
+// with its own minimum Level and Encoder, can be layered on with AddSink,
+// e.g. to also send WARN-and-above to stderr as text while everything goes
+// to the file as JSON:
+//
+//	logger.AddSink(&glog.StderrSink{MinimumLevel: glog.Lwarn, Enc: glog.EncoderText})
+//
+// LogOptions.Async makes the default file sink non-blocking: records are
+// queued and written by a dedicated goroutine instead of on the caller's
+// goroutine, so a slow disk doesn't stall every logging call. Set
+// AsyncOverflow to decide what happens if that goroutine falls behind and
+// the queue (sized by AsyncBufferSize) fills up; DroppedRecords and
+// QueueDepth report the resulting backpressure.
 package glog
 
 import (
 	"bufio"
+	"compress/gzip"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 // These flags define which text to prefix to each log entry generated by the Logger.
@@ -102,6 +140,28 @@ const (
 	R_Day                    // Rotate file by day
 )
 
+// Encoder selects how a Sink renders a record. It applies to records from
+// the printf-style API (Debug, Debugf, ...) and the structured logging API
+// (With, Debugw, Infow, Warnw, Errorw) alike; with EncoderText, structured
+// fields are appended to the text as key=value pairs.
+type Encoder int
+
+const (
+	EncoderText   Encoder = iota // human-readable text, like the printf-style API
+	EncoderJSON                  // one JSON object per record
+	EncoderLogfmt                // key=value pairs, one record per line
+)
+
+// OverflowPolicy controls what an async-mode Sink does when its queue is
+// full; see LogOptions.Async.
+type OverflowPolicy int
+
+const (
+	OverflowBlock      OverflowPolicy = iota // block the caller until the queue has room
+	OverflowDropOldest                       // discard the oldest queued record to make room
+	OverflowDropNewest                       // discard the incoming record
+)
+
 // LogOptions control logger's behaviour.
 type LogOptions struct {
 	File    string     // base name for log file
@@ -109,66 +169,159 @@ type LogOptions struct {
 	Level   Level      // threshold level for logging
 	Mode    RotateMode // file rotating mode
 	Maxsize uint64     // maximum size for R_Size mode
+	Encoder Encoder    // record encoding for the default file sink
+
+	// Retention policy for rotated backups (Mode != R_None). A janitor runs
+	// asynchronously after each rotation; the currently open file is never
+	// touched regardless of these settings.
+	MaxAge     time.Duration // delete backups older than this; zero disables age-based pruning
+	MaxBackups int           // keep at most this many newest backups; zero disables count-based pruning
+	Compress   bool          // gzip retained backups in place with a .gz suffix
+
+	// Async, if true, makes the default file sink non-blocking: Output
+	// enqueues the rendered record and returns immediately, while a
+	// dedicated goroutine drains the queue to disk, coalescing whatever is
+	// already queued into a single Write call per drain. AsyncBufferSize
+	// sets the queue's capacity (defaultAsyncBufferSize if <= 0), and
+	// AsyncOverflow decides what happens once it's full.
+	Async           bool
+	AsyncBufferSize int
+	AsyncOverflow   OverflowPolicy
 }
 
 // A Logger represents an active logging object that generates lines of
-// output to an io.Writer.  Each logging operation makes a single call to
-// the Writer's Write method.  A Logger can be used simultaneously from
-// multiple goroutines; it guarantees to serialize access to the Writer.
+// output to one or more Sinks.  A Logger can be used simultaneously from
+// multiple goroutines; each Sink guarantees to serialize access to its own
+// destination.
+//
+// A Logger returned by With shares its core (sinks, flags, level, verbosity)
+// with the Logger it was derived from, and adds its own fields to every
+// structured record it emits.
 type Logger struct {
-	options    LogOptions
-	freeList   *buffer
-	freeListMu sync.Mutex
+	core   *core
+	fields []field // key/value context attached via With
+}
 
-	mu     sync.Mutex    // ensures atomic writes; protects the following fields
-	out    *bufio.Writer // destination for output
-	file   *os.File
-	nbytes uint64
-	hour   int
-	day    int
+// core holds the mutable output state shared by a Logger and every child
+// Logger derived from it via With.
+type core struct {
+	flag  atomic.Int32 // log entry prefix flag, see LstdFlags et al.
+	level atomic.Int32 // threshold Level for logging
+
+	bufPool sync.Pool // pool of []byte record buffers, see getBuffer/putBuffer
+
+	sinksMu     sync.RWMutex
+	sinks       []Sink     // every destination a record is fanned out to
+	defaultSink *fileSink  // the sink New(options) built; SetOutput redirects it
+	async       *asyncSink // set when LogOptions.Async wraps defaultSink; nil otherwise
+
+	verbosity int32 // global V() threshold, set via SetVerbosity
+
+	vmoduleMu sync.RWMutex
+	vmodule   []modulePat // per-file/pattern V() overrides, set via SetVModule
+
+	// vcache maps uintptr (call site PC) -> VLevel. SetVModule swaps in a
+	// fresh, empty map rather than mutating the old one in place, so V can
+	// Load from it without synchronizing against SetVModule.
+	vcache atomic.Pointer[sync.Map]
 }
 
-type buffer struct {
-	buf  []byte
-	next *buffer
+// Sink is a logging destination a Logger can fan a record out to. Each Sink
+// decides, via MinLevel and Encoder, which records it wants and how they
+// should be rendered before Write is called; this lets one Logger send
+// everything to a file as JSON while only WARN-and-above also reach stderr
+// as text.
+type Sink interface {
+	// MinLevel reports the lowest Level this sink accepts; the Logger
+	// skips the sink entirely for records below it.
+	MinLevel() Level
+	// Encoder reports how the Logger should render a record before
+	// passing it to Write.
+	Encoder() Encoder
+	// Write writes one already-rendered record for level.
+	Write(level Level, record []byte) error
+	// Flush flushes any buffered data toward stable storage.
+	Flush() error
+	// Close releases any resources held by the sink.
+	Close() error
 }
 
-// getBuffer returns a new, ready-to-use buffer.
-func (l *Logger) getBuffer() *buffer {
-	l.freeListMu.Lock()
-	b := l.freeList
-	if b != nil {
-		l.freeList = b.next
-	}
-	l.freeListMu.Unlock()
-	if b == nil {
-		b = &buffer{buf: make([]byte, 64)}
-	} else {
-		b.next = nil
-	}
-	return b
+// StderrSink writes records to os.Stderr with no rotation, a common pairing
+// with a rotating file sink: e.g. MinimumLevel: Lwarn to surface only
+// warnings and above on the console while the file keeps everything.
+type StderrSink struct {
+	MinimumLevel Level
+	Enc          Encoder
 }
 
-// putBuffer returns a buffer to the free list.
-func (l *Logger) putBuffer(b *buffer) {
-	if len(b.buf) >= 256 {
+// MinLevel implements Sink.
+func (s *StderrSink) MinLevel() Level { return s.MinimumLevel }
+
+// Encoder implements Sink.
+func (s *StderrSink) Encoder() Encoder { return s.Enc }
+
+// Write implements Sink.
+func (s *StderrSink) Write(_ Level, record []byte) error {
+	_, err := os.Stderr.Write(record)
+	return err
+}
+
+// Flush implements Sink; os.Stderr is unbuffered, so this is a no-op.
+func (s *StderrSink) Flush() error { return nil }
+
+// Close implements Sink; os.Stderr is never closed.
+func (s *StderrSink) Close() error { return nil }
+
+// field is one key/value pair attached to a Logger via With.
+type field struct {
+	key string
+	val interface{}
+}
+
+// maxPooledBufSize bounds the size of buffers kept in bufPool, mirroring the
+// limit fmt places on its own internal buffer pool: a record built from an
+// unusually large argument is let go rather than pinning that much memory.
+const maxPooledBufSize = 64 << 10
+
+// getBuffer returns a ready-to-use, zero-length buffer from the pool.
+func (l *Logger) getBuffer() []byte {
+	return l.core.bufPool.Get().([]byte)[:0]
+}
+
+// putBuffer returns a buffer to the pool for reuse.
+func (l *Logger) putBuffer(b []byte) {
+	if cap(b) > maxPooledBufSize {
 		// Let big buffers die a natural death.
 		return
 	}
-	l.freeListMu.Lock()
-	b.next = l.freeList
-	l.freeList = b
-	l.freeListMu.Unlock()
+	l.core.bufPool.Put(b)
 }
 
-// New creates a new Logger.   The out variable sets the
-// destination to which log data will be written.
-// The prefix appears at the beginning of each generated log line.
-// The flag argument defines the logging properties.
+// New creates a new Logger with a single rotating file Sink built from
+// options. Additional destinations can be layered on with AddSink.
 func New(options LogOptions) (*Logger, error) {
-	logger := &Logger{options: options}
+	c := &core{}
+	c.flag.Store(int32(options.Flag))
+	c.level.Store(int32(options.Level))
+	c.bufPool.New = func() interface{} { return make([]byte, 0, 64) }
+	c.vcache.Store(&sync.Map{})
+
+	logger := &Logger{core: c}
+
+	fs, err := newFileSink(options)
+	c.defaultSink = fs
+
+	var sink Sink = fs
+	if options.Async {
+		bufSize := options.AsyncBufferSize
+		if bufSize <= 0 {
+			bufSize = defaultAsyncBufferSize
+		}
+		c.async = newAsyncSink(fs, bufSize, options.AsyncOverflow)
+		sink = c.async
+	}
+	c.sinks = []Sink{sink}
 
-	err := logger.createFile(time.Now())
 	if err != nil {
 		return logger, err
 	}
@@ -177,32 +330,269 @@ func New(options LogOptions) (*Logger, error) {
 	return logger, nil
 }
 
+// DroppedRecords reports how many records the default sink's async queue
+// has discarded under OverflowDropOldest/OverflowDropNewest. It is always
+// zero unless LogOptions.Async was set.
+func (l *Logger) DroppedRecords() int64 {
+	if l.core.async == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&l.core.async.dropped)
+}
+
+// QueueDepth reports the default sink's current async queue length. It is
+// always zero unless LogOptions.Async was set.
+func (l *Logger) QueueDepth() int64 {
+	if l.core.async == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&l.core.async.depth)
+}
+
+// With returns a child Logger that carries kv as additional structured
+// fields on every Debugw/Infow/Warnw/Errorw call. kv is a flat list of
+// alternating keys and values, e.g. With("request_id", id, "user", name).
+// The child shares the parent's sinks, flags, level and verbosity settings;
+// changing those through either Logger affects both.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]field, 0, len(l.fields)+len(kv)/2)
+	fields = append(fields, l.fields...)
+	fields = append(fields, parseFields(kv)...)
+	return &Logger{core: l.core, fields: fields}
+}
+
+// parseFields turns a flat key/value list into fields, coercing a
+// non-string key to its fmt.Sprint form and dropping a trailing key left
+// without a matching value.
+func parseFields(kv []interface{}) []field {
+	fields := make([]field, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			key = fmt.Sprint(kv[i])
+		}
+		fields = append(fields, field{key: key, val: kv[i+1]})
+	}
+	return fields
+}
+
+// SetFlag sets the log entry prefix flags, see LstdFlags et al. It may be
+// called concurrently with logging.
+func (l *Logger) SetFlag(flag int) {
+	l.core.flag.Store(int32(flag))
+}
+
+// SetLevel sets the threshold Level for logging. It may be called
+// concurrently with logging.
+func (l *Logger) SetLevel(level Level) {
+	l.core.level.Store(int32(level))
+}
+
+// SetOutput redirects the default file sink's subsequent records to w,
+// flushing and closing any previously open rotated file. Rotation
+// (Mode/Maxsize) no longer applies to that sink once SetOutput has been
+// called, since there is no longer a file for createFile to roll over.
+// It has no effect on sinks added with AddSink.
+func (l *Logger) SetOutput(w io.Writer) {
+	l.core.defaultSink.setOutput(w)
+}
+
+// AddSink registers s as an additional destination for this Logger's
+// records; s's own MinLevel and Encoder control which records it receives
+// and how they are rendered.
+func (l *Logger) AddSink(s Sink) {
+	c := l.core
+	c.sinksMu.Lock()
+	c.sinks = append(c.sinks, s)
+	c.sinksMu.Unlock()
+}
+
+// RemoveSink unregisters s and then flushes it. It is a no-op if s was not
+// registered.
+func (l *Logger) RemoveSink(s Sink) {
+	c := l.core
+	c.sinksMu.Lock()
+	removed := false
+	for i, sink := range c.sinks {
+		if sink == s {
+			c.sinks = append(c.sinks[:i:i], c.sinks[i+1:]...)
+			removed = true
+			break
+		}
+	}
+	c.sinksMu.Unlock()
+	if removed {
+		s.Flush()
+	}
+}
+
 // bufferSize sizes the buffer associated with each log file. It's large
 // so that log records can accumulate without the logging thread blocking
 // on disk I/O. The flushDaemon will block instead.
 const bufferSize = 256 * 1024
 
+// fileSink is the rotating file Sink New builds from LogOptions. It owns
+// the rotation, retention and buffered-write logic the package has always
+// used for its file output; other Sink implementations (StderrSink, a
+// syslog or network sink, ...) don't need any of it.
+type fileSink struct {
+	options LogOptions
+
+	mu     sync.Mutex    // ensures atomic writes; protects the following fields
+	out    *bufio.Writer // destination for output
+	file   *os.File
+	nbytes uint64
+	hour   int
+	day    int
+
+	redirected bool // set by setOutput; Write no longer rotates
+}
+
+// newFileSink creates the initial log file described by options. Like New,
+// it returns the *fileSink even alongside a non-nil error. In R_Hour and
+// R_Day mode the next Write then retries creating the file; in R_None and
+// R_Size mode no retry happens and the sink is left without a writer.
+func newFileSink(options LogOptions) (*fileSink, error) {
+	fs := &fileSink{options: options}
+	return fs, fs.createFile(time.Now())
+}
+
+// MinLevel implements Sink. The file sink has no level filtering of its
+// own; LogOptions.Level already gates calls before they reach any sink.
+func (fs *fileSink) MinLevel() Level { return Ldebug }
+
+// Encoder implements Sink.
+func (fs *fileSink) Encoder() Encoder { return fs.options.Encoder }
+
+// Write implements Sink: it rotates the file if needed, then writes record.
+func (fs *fileSink) Write(_ Level, record []byte) error {
+	now := time.Now()
+
+	fs.mu.Lock()
+	rotate := false
+	mode := fs.options.Mode
+	if fs.redirected {
+		mode = R_None
+	}
+	switch mode {
+	case R_Size:
+		if fs.nbytes+uint64(len(record)) > fs.options.Maxsize {
+			rotate = true
+		}
+	case R_Hour:
+		if fs.hour != now.Hour() || fs.day != now.Day() {
+			rotate = true
+		}
+	case R_Day:
+		if fs.day != now.Day() {
+			rotate = true
+		}
+	}
+
+	if rotate {
+		if err := fs.createFile(now); err != nil {
+			fmt.Fprintf(os.Stderr, "log: exiting because of error: %s\n", err)
+			os.Exit(2)
+		}
+	}
+	_, err := fs.out.Write(record)
+	fs.nbytes += uint64(len(record))
+	fs.mu.Unlock()
+
+	return err
+}
+
+// Flush implements Sink.
+func (fs *fileSink) Flush() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.out.Flush()
+	return fs.file.Sync()
+}
+
+// Close implements Sink.
+func (fs *fileSink) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.out.Flush()
+	return fs.file.Close()
+}
+
+// setOutput backs Logger.SetOutput: it redirects subsequent writes to w,
+// flushing and closing any previously open file. Rotation no longer
+// applies afterward, since there is no longer a file for createFile to
+// roll over.
+func (fs *fileSink) setOutput(w io.Writer) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.out != nil {
+		fs.out.Flush()
+	}
+	if fs.file != nil {
+		fs.file.Close()
+		fs.file = nil
+	}
+	fs.out = bufio.NewWriterSize(w, bufferSize)
+	fs.redirected = true
+}
+
+// uniqueBackupName returns base, or base with a "-N" counter appended if
+// base already exists, increasing N until it finds a name that doesn't.
+// Used by createFile's R_Size case, where a write burst can compute the
+// same second-resolution name for more than one rotation.
+func uniqueBackupName(base string) string {
+	if !fileExists(base) {
+		return base
+	}
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s-%d", base, n)
+		if !fileExists(candidate) {
+			return candidate
+		}
+	}
+}
+
+// fileExists reports whether a file (or any other directory entry) already
+// exists at path.
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
 // createFile creates log file with specified timestamp.
-// l.mu held
-func (l *Logger) createFile(t time.Time) error {
+// fs.mu held
+func (fs *fileSink) createFile(t time.Time) error {
 	year, month, day := t.Date()
 	hour, min, sec := t.Clock()
 
 	var file string
-	switch l.options.Mode {
+	switch fs.options.Mode {
 	case R_Size:
-		file = fmt.Sprintf("%s-%04d%02d%02d-%02d%02d%02d", l.options.File, year, month, day, hour, min, sec)
+		// A write burst can trigger more than one rotation within the same
+		// second, and the suffix only has second resolution: reusing the
+		// same name would reopen the backup we're rotating away from
+		// instead of starting a new one, so disambiguate on collision.
+		base := fmt.Sprintf("%s-%04d%02d%02d-%02d%02d%02d", fs.options.File, year, month, day, hour, min, sec)
+		file = uniqueBackupName(base)
 	case R_Hour:
-		file = fmt.Sprintf("%s-%04d%02d%02d-%02d", l.options.File, year, month, day, hour)
+		file = fmt.Sprintf("%s-%04d%02d%02d-%02d", fs.options.File, year, month, day, hour)
 	case R_Day:
-		file = fmt.Sprintf("%s-%04d%02d%02d", l.options.File, year, month, day)
+		file = fmt.Sprintf("%s-%04d%02d%02d", fs.options.File, year, month, day)
 	default: // R_None
-		file = l.options.File
+		file = fs.options.File
 	}
 
-	if l.file != nil {
-		l.out.Flush()
-		l.file.Close()
+	// listBackups compares candidates against filepath.Join(dir, name),
+	// which is always cleaned; if options.File carries a "./" prefix or
+	// other uncleaned element (e.g. the documented "./abc.log" usage),
+	// an uncleaned file here would never match and janitor would treat
+	// the active file as an ordinary backup to prune.
+	file = filepath.Clean(file)
+
+	if fs.file != nil {
+		fs.out.Flush()
+		fs.file.Close()
 	}
 
 	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0664)
@@ -210,15 +600,378 @@ func (l *Logger) createFile(t time.Time) error {
 		return err
 	}
 
-	l.file = f
-	l.out = bufio.NewWriterSize(f, bufferSize)
-	l.nbytes = 0
-	l.hour = hour
-	l.day = day
+	fs.file = f
+	fs.out = bufio.NewWriterSize(f, bufferSize)
+	fs.nbytes = 0
+	fs.hour = hour
+	fs.day = day
+
+	if fs.options.Mode != R_None {
+		go fs.janitor(file)
+	}
 
 	return nil
 }
 
+// defaultAsyncBufferSize is used when LogOptions.Async is set but
+// AsyncBufferSize isn't.
+const defaultAsyncBufferSize = 1024
+
+// asyncItem is one entry on an asyncSink's queue: either a record to write,
+// or a flush barrier (used by asyncSink.Flush to wait for everything ahead
+// of it to reach next before syncing).
+type asyncItem struct {
+	level   Level
+	record  []byte
+	barrier chan struct{} // non-nil for a Flush barrier; level/record unused
+}
+
+// asyncSink wraps another Sink to make Write non-blocking: records are
+// copied and queued on a bounded channel, and a dedicated goroutine writes
+// them to next, coalescing whatever is already queued into a single Write
+// call per drain so a burst of records costs one disk write instead of
+// many. It implements Sink itself so it can replace next directly in
+// core.sinks.
+type asyncSink struct {
+	next     Sink
+	overflow OverflowPolicy
+
+	queue chan asyncItem
+	stop  chan struct{} // closed by Close to tell run to drain and exit
+
+	// closeMu guards closed against the race between Close and a
+	// concurrent Write/Flush: the queue itself is never closed (other
+	// goroutines may still be sending on it), so Close instead flips
+	// closed under the write lock and every send happens under the read
+	// lock, ensuring no send starts once Close has committed to shutting
+	// run down.
+	closeMu sync.RWMutex
+	closed  bool
+
+	stopped chan struct{} // closed once run's goroutine returns
+
+	dropped int64 // atomic, see Logger.DroppedRecords
+	depth   int64 // atomic, see Logger.QueueDepth
+}
+
+// newAsyncSink starts the draining goroutine and returns the wrapper.
+func newAsyncSink(next Sink, bufferSize int, overflow OverflowPolicy) *asyncSink {
+	a := &asyncSink{
+		next:     next,
+		overflow: overflow,
+		queue:    make(chan asyncItem, bufferSize),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// MinLevel implements Sink, delegating to next.
+func (a *asyncSink) MinLevel() Level { return a.next.MinLevel() }
+
+// Encoder implements Sink, delegating to next.
+func (a *asyncSink) Encoder() Encoder { return a.next.Encoder() }
+
+// Write implements Sink: it copies record (the caller reclaims its own
+// buffer as soon as Write returns) and enqueues it, applying overflow only
+// to that enqueue. It is a silent no-op once Close has been called.
+func (a *asyncSink) Write(level Level, record []byte) error {
+	a.closeMu.RLock()
+	defer a.closeMu.RUnlock()
+	if a.closed {
+		return nil
+	}
+
+	cp := make([]byte, len(record))
+	copy(cp, record)
+	item := asyncItem{level: level, record: cp}
+
+	switch a.overflow {
+	case OverflowDropNewest:
+		select {
+		case a.queue <- item:
+			atomic.AddInt64(&a.depth, 1)
+		default:
+			atomic.AddInt64(&a.dropped, 1)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case a.queue <- item:
+				atomic.AddInt64(&a.depth, 1)
+				return nil
+			default:
+			}
+			select {
+			case old := <-a.queue:
+				if old.barrier != nil {
+					// A Flush is waiting on this barrier: requeue it
+					// instead of discarding it.
+					a.queue <- old
+					continue
+				}
+				atomic.AddInt64(&a.depth, -1)
+				atomic.AddInt64(&a.dropped, 1)
+			default:
+			}
+		}
+	default: // OverflowBlock
+		a.queue <- item
+		atomic.AddInt64(&a.depth, 1)
+	}
+	return nil
+}
+
+// Flush implements Sink: it waits for the draining goroutine to have
+// written everything queued ahead of this call to next, then syncs next.
+// Once Close has been called it just syncs next, since run is no longer
+// reading the queue.
+func (a *asyncSink) Flush() error {
+	a.closeMu.RLock()
+	if a.closed {
+		a.closeMu.RUnlock()
+		return a.next.Flush()
+	}
+	barrier := make(chan struct{})
+	a.queue <- asyncItem{barrier: barrier}
+	a.closeMu.RUnlock()
+
+	<-barrier
+	return a.next.Flush()
+}
+
+// Close implements Sink: it stops accepting new records, waits for run to
+// drain whatever is already queued, and closes next.
+func (a *asyncSink) Close() error {
+	a.closeMu.Lock()
+	if a.closed {
+		a.closeMu.Unlock()
+		return nil
+	}
+	a.closed = true
+	a.closeMu.Unlock()
+
+	close(a.stop)
+	<-a.stopped
+	return a.next.Close()
+}
+
+// run drains the queue until told to stop, coalescing whatever is already
+// queued at each step into a single Write call to next.
+func (a *asyncSink) run() {
+	defer close(a.stopped)
+
+	var batch []byte
+	var batchLevel Level
+	flushBatch := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := a.next.Write(batchLevel, batch); err != nil {
+			fmt.Fprintf(os.Stderr, "log: async sink write error: %s\n", err)
+		}
+		batch = nil
+	}
+	handle := func(item asyncItem) {
+		if item.barrier != nil {
+			flushBatch()
+			close(item.barrier)
+			return
+		}
+		atomic.AddInt64(&a.depth, -1)
+		batch = append(batch, item.record...)
+		batchLevel = item.level
+	}
+
+	for {
+		select {
+		case item := <-a.queue:
+			handle(item)
+		drain:
+			for {
+				select {
+				case more := <-a.queue:
+					handle(more)
+				default:
+					break drain
+				}
+			}
+			flushBatch()
+		case <-a.stop:
+			for {
+				select {
+				case item := <-a.queue:
+					handle(item)
+				default:
+					flushBatch()
+					return
+				}
+			}
+		}
+	}
+}
+
+// rotateSuffix matches a rotated backup's file name against its rotate
+// suffix for each RotateMode, capturing the base name, the timestamp, and
+// an optional ".gz" left by a previous Compress pass. For R_Size, a
+// "-N" disambiguator from uniqueBackupName may appear between the
+// timestamp and ".gz"; it isn't captured since listBackups only needs the
+// base name and timestamp to place a backup relative to the active file.
+var rotateSuffix = map[RotateMode]*regexp.Regexp{
+	R_Size: regexp.MustCompile(`^(.+)-(\d{8}-\d{6})(?:-\d+)?(\.gz)?$`),
+	R_Hour: regexp.MustCompile(`^(.+)-(\d{8}-\d{2})(\.gz)?$`),
+	R_Day:  regexp.MustCompile(`^(.+)-(\d{8})(\.gz)?$`),
+}
+
+// rotateLayout is the time.Parse layout matching the timestamp captured by
+// the corresponding rotateSuffix pattern.
+var rotateLayout = map[RotateMode]string{
+	R_Size: "20060102-150405",
+	R_Hour: "20060102-15",
+	R_Day:  "20060102",
+}
+
+// backupFile is one rotated sibling of the active log file, as found by
+// listBackups.
+type backupFile struct {
+	path string
+	t    time.Time
+}
+
+// listBackups returns the rotated siblings of the active log file in the
+// same directory, sorted newest first. current is excluded so the janitor
+// never considers the file it was just told about.
+func (fs *fileSink) listBackups(current string) ([]backupFile, error) {
+	re, ok := rotateSuffix[fs.options.Mode]
+	if !ok {
+		return nil, nil
+	}
+	layout := rotateLayout[fs.options.Mode]
+
+	dir := filepath.Dir(fs.options.File)
+	base := filepath.Base(fs.options.File)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []backupFile
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		full := filepath.Join(dir, e.Name())
+		if full == current {
+			continue
+		}
+		m := re.FindStringSubmatch(e.Name())
+		if m == nil || m[1] != base {
+			continue
+		}
+		t, err := time.ParseInLocation(layout, m[2], time.Local)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backupFile{path: full, t: t})
+	}
+
+	sort.Slice(backups, func(i, j int) bool { return backups[i].t.After(backups[j].t) })
+	return backups, nil
+}
+
+// janitor enforces MaxAge, MaxBackups and Compress on the rotated siblings
+// of current, the file createFile just opened. It runs in its own goroutine
+// so a directory scan or gzip pass never blocks a caller's Write, and only
+// takes fs.mu for the brief remove/rename steps that touch the filesystem
+// state Write also touches.
+func (fs *fileSink) janitor(current string) {
+	if fs.options.MaxAge <= 0 && fs.options.MaxBackups <= 0 && !fs.options.Compress {
+		return
+	}
+
+	backups, err := fs.listBackups(current)
+	if err != nil {
+		return
+	}
+
+	var stale []backupFile
+	if fs.options.MaxBackups > 0 && len(backups) > fs.options.MaxBackups {
+		stale = append(stale, backups[fs.options.MaxBackups:]...)
+		backups = backups[:fs.options.MaxBackups]
+	}
+	if fs.options.MaxAge > 0 {
+		cutoff := time.Now().Add(-fs.options.MaxAge)
+		kept := backups[:0]
+		for _, b := range backups {
+			if b.t.Before(cutoff) {
+				stale = append(stale, b)
+			} else {
+				kept = append(kept, b)
+			}
+		}
+		backups = kept
+	}
+
+	fs.mu.Lock()
+	for _, b := range stale {
+		os.Remove(b.path)
+	}
+	fs.mu.Unlock()
+
+	if fs.options.Compress {
+		for _, b := range backups {
+			if strings.HasSuffix(b.path, ".gz") {
+				continue
+			}
+			fs.compressBackup(b.path)
+		}
+	}
+}
+
+// compressBackup gzips path in place as path+".gz". The gzip pass itself
+// runs unlocked against a temp file; only the final rename and removal of
+// the original, which mutate directory state Write's rotation check also
+// relies on, are done under fs.mu.
+func (fs *fileSink) compressBackup(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
+	if err != nil {
+		return err
+	}
+
+	gw := gzip.NewWriter(dst)
+	_, copyErr := io.Copy(gw, src)
+	if closeErr := gw.Close(); copyErr == nil {
+		copyErr = closeErr
+	}
+	if closeErr := dst.Close(); copyErr == nil {
+		copyErr = closeErr
+	}
+	if copyErr != nil {
+		os.Remove(tmp)
+		return copyErr
+	}
+
+	fs.mu.Lock()
+	err = os.Rename(tmp, path+".gz")
+	if err == nil {
+		err = os.Remove(path)
+	}
+	fs.mu.Unlock()
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
 // Cheap integer to fixed-width decimal ASCII.  Give a negative width to avoid zero-padding.
 func itoa(buf *[]byte, i int, wid int) {
 	// Assemble decimal in reverse order.
@@ -236,61 +989,56 @@ func itoa(buf *[]byte, i int, wid int) {
 	*buf = append(*buf, b[bp:]...)
 }
 
-func (l *Logger) formatHeader(buf *[]byte, s Level, calldepth int, t time.Time) {
-	flag := l.options.Flag
+// appendTextRecord appends msg and fields as a free-form text record,
+// honoring the date/time, caller and level flag bits the way the printf-
+// style API always has.
+func appendTextRecord(buf []byte, flag int, level Level, t time.Time, file string, line int, msg string, fields []field) []byte {
 	if flag&LUTC != 0 {
 		t = t.UTC()
 	}
 	if flag&(Ldate|Ltime|Lmicroseconds) != 0 {
 		if flag&Ldate != 0 {
 			year, month, day := t.Date()
-			itoa(buf, year, 4)
-			*buf = append(*buf, '/')
-			itoa(buf, int(month), 2)
-			*buf = append(*buf, '/')
-			itoa(buf, day, 2)
-			*buf = append(*buf, ' ')
+			itoa(&buf, year, 4)
+			buf = append(buf, '/')
+			itoa(&buf, int(month), 2)
+			buf = append(buf, '/')
+			itoa(&buf, day, 2)
+			buf = append(buf, ' ')
 		}
 		if flag&(Ltime|Lmicroseconds) != 0 {
 			hour, min, sec := t.Clock()
-			itoa(buf, hour, 2)
-			*buf = append(*buf, ':')
-			itoa(buf, min, 2)
-			*buf = append(*buf, ':')
-			itoa(buf, sec, 2)
+			itoa(&buf, hour, 2)
+			buf = append(buf, ':')
+			itoa(&buf, min, 2)
+			buf = append(buf, ':')
+			itoa(&buf, sec, 2)
 			if flag&Lmicroseconds != 0 {
-				*buf = append(*buf, '.')
-				itoa(buf, t.Nanosecond()/1e3, 6)
+				buf = append(buf, '.')
+				itoa(&buf, t.Nanosecond()/1e3, 6)
 			}
-			*buf = append(*buf, ' ')
+			buf = append(buf, ' ')
 		}
 	}
 	if flag&(Lshortfile|Llongfile) != 0 {
-		_, file, line, ok := runtime.Caller(calldepth)
-		if !ok {
-			file = "???"
-			line = 0
-		}
-
 		if flag&Lshortfile != 0 {
-			short := file
-			for i := len(file) - 1; i > 0; i-- {
-				if file[i] == '/' {
-					short = file[i+1:]
-					break
-				}
-			}
-			file = short
+			file = filepath.Base(file)
 		}
-		*buf = append(*buf, file...)
-		*buf = append(*buf, ':')
-		itoa(buf, line, -1)
-		*buf = append(*buf, ' ')
+		buf = append(buf, file...)
+		buf = append(buf, ':')
+		itoa(&buf, line, -1)
+		buf = append(buf, ' ')
 	}
 	if flag&Llevel != 0 {
-		*buf = append(*buf, levelName[s]...)
-		*buf = append(*buf, ' ')
+		buf = append(buf, levelName[level]...)
+		buf = append(buf, ' ')
 	}
+	buf = append(buf, msg...)
+	buf = appendLogfmtFields(buf, fields)
+	if len(buf) == 0 || buf[len(buf)-1] != '\n' {
+		buf = append(buf, '\n')
+	}
+	return buf
 }
 
 // Output writes the output for a logging event.  The string s contains
@@ -300,55 +1048,94 @@ func (l *Logger) formatHeader(buf *[]byte, s Level, calldepth int, t time.Time)
 // provided for generality, although at the moment on all pre-defined
 // paths it will be 2.
 func (l *Logger) Output(level Level, calldepth int, s string) error {
-	b := l.getBuffer()
-	defer l.putBuffer(b)
+	return l.emit(level, calldepth, s, nil)
+}
 
-	now := time.Now() // get this early.
+// outputw writes a structured logging event: msg plus l.fields and any
+// additional kv pairs. calldepth mirrors Output's.
+func (l *Logger) outputw(level Level, calldepth int, msg string, kv []interface{}) error {
+	fields := l.fields
+	if len(kv) > 0 {
+		fields = make([]field, 0, len(l.fields)+len(kv)/2)
+		fields = append(fields, l.fields...)
+		fields = append(fields, parseFields(kv)...)
+	}
+	return l.emit(level, calldepth, msg, fields)
+}
+
+// emit renders msg once per Sink that accepts level, in that sink's own
+// Encoder, and dispatches the result to it. The caller's file and line are
+// resolved at most once per call regardless of how many sinks want it.
+func (l *Logger) emit(level Level, calldepth int, msg string, fields []field) error {
+	c := l.core
 
-	b.buf = b.buf[:0]
-	l.formatHeader(&b.buf, level, calldepth, now)
-	b.buf = append(b.buf, s...)
-	if len(s) == 0 || s[len(s)-1] != '\n' {
-		b.buf = append(b.buf, '\n')
+	c.sinksMu.RLock()
+	sinks := append([]Sink(nil), c.sinks...)
+	c.sinksMu.RUnlock()
+	if len(sinks) == 0 {
+		return nil
 	}
 
-	l.mu.Lock()
-	rotate := false
-	switch l.options.Mode {
-	case R_Size:
-		if l.nbytes+uint64(len(b.buf)) > l.options.Maxsize {
-			rotate = true
-		}
-	case R_Hour:
-		if l.hour != now.Hour() || l.day != now.Day() {
-			rotate = true
-		}
-	case R_Day:
-		if l.day != now.Day() {
-			rotate = true
+	now := time.Now()
+	flag := int(c.flag.Load())
+
+	var file string
+	var line int
+	if flag&(Lshortfile|Llongfile) != 0 {
+		var ok bool
+		_, file, line, ok = runtime.Caller(calldepth)
+		if !ok {
+			file, line = "???", 0
 		}
 	}
 
-	if rotate {
-		if err := l.createFile(now); err != nil {
-			fmt.Fprintf(os.Stderr, "log: exiting because of error: %s\n", err)
-			os.Exit(2)
+	var firstErr error
+	for _, sink := range sinks {
+		if level < sink.MinLevel() {
+			continue
+		}
+		buf := l.getBuffer()
+		buf = appendRecord(buf, sink.Encoder(), flag, level, now, file, line, msg, fields)
+		if err := sink.Write(level, buf); err != nil && firstErr == nil {
+			firstErr = err
 		}
+		l.putBuffer(buf)
 	}
-	_, err := l.out.Write(b.buf)
-	l.nbytes += uint64(len(b.buf))
 
 	if level == Lfatal {
 		trace := stacks(true)
-		l.out.Write(trace)
-		l.out.Flush()
-		l.file.Close()
-		l.mu.Unlock()
+		for _, sink := range sinks {
+			sink.Write(Lfatal, trace)
+			sink.Flush()
+			sink.Close()
+		}
 		os.Exit(255)
 	}
 
-	l.mu.Unlock()
-	return err
+	return firstErr
+}
+
+// appendRecord renders msg and fields per enc, the way Output and outputw
+// have always rendered EncoderText and the structured API's EncoderJSON/
+// EncoderLogfmt respectively.
+func appendRecord(buf []byte, enc Encoder, flag int, level Level, t time.Time, file string, line int, msg string, fields []field) []byte {
+	if enc == EncoderText {
+		return appendTextRecord(buf, flag, level, t, file, line, msg, fields)
+	}
+
+	var caller string
+	if flag&(Lshortfile|Llongfile) != 0 {
+		f := file
+		if flag&Lshortfile != 0 {
+			f = filepath.Base(f)
+		}
+		caller = fmt.Sprintf("%s:%d", f, line)
+	}
+
+	if enc == EncoderJSON {
+		return appendJSONRecord(buf, flag, level, t, caller, msg, fields)
+	}
+	return appendLogfmtRecord(buf, flag, level, t, caller, msg, fields)
 }
 
 // stacks is a wrapper for runtime.Stack that attempts to recover the data for all goroutines.
@@ -370,12 +1157,15 @@ func stacks(all bool) []byte {
 	return trace
 }
 
-// Flush flush buffered data to underlying file and sync contents to stable storage.
+// Flush flushes every Sink's buffered data and syncs it to stable storage.
 func (l *Logger) Flush() {
-	l.mu.Lock()
-	l.out.Flush()
-	l.file.Sync()
-	l.mu.Unlock()
+	c := l.core
+	c.sinksMu.RLock()
+	sinks := append([]Sink(nil), c.sinks...)
+	c.sinksMu.RUnlock()
+	for _, s := range sinks {
+		s.Flush()
+	}
 }
 
 const flushInterval = 30 * time.Second
@@ -390,7 +1180,7 @@ func (l *Logger) flushDaemon() {
 // Debugf calls l.Output to print to the logger.
 // Arguments are handled in the manner of fmt.Printf.
 func (l *Logger) Debugf(format string, v ...interface{}) {
-	if l.options.Level <= Ldebug {
+	if l.core.level.Load() <= int32(Ldebug) {
 		l.Output(Ldebug, 3, fmt.Sprintf(format, v...))
 	}
 }
@@ -398,7 +1188,7 @@ func (l *Logger) Debugf(format string, v ...interface{}) {
 // Debug calls l.Output to print to the logger.
 // Arguments are handled in the manner of fmt.Print.
 func (l *Logger) Debug(v ...interface{}) {
-	if l.options.Level <= Ldebug {
+	if l.core.level.Load() <= int32(Ldebug) {
 		l.Output(Ldebug, 3, fmt.Sprint(v...))
 	}
 }
@@ -406,15 +1196,24 @@ func (l *Logger) Debug(v ...interface{}) {
 // Debugln calls l.Output to print to the logger.
 // Arguments are handled in the manner of fmt.Println.
 func (l *Logger) Debugln(v ...interface{}) {
-	if l.options.Level <= Ldebug {
+	if l.core.level.Load() <= int32(Ldebug) {
 		l.Output(Ldebug, 3, fmt.Sprintln(v...))
 	}
 }
 
+// Debugw logs msg and kv (plus any fields from With) as a structured
+// record, encoded per LogOptions.Encoder.
+// Arguments are handled in the manner of With: alternating keys and values.
+func (l *Logger) Debugw(msg string, kv ...interface{}) {
+	if l.core.level.Load() <= int32(Ldebug) {
+		l.outputw(Ldebug, 3, msg, kv)
+	}
+}
+
 // Infof calls l.Output to print to the logger.
 // Arguments are handled in the manner of fmt.Printf.
 func (l *Logger) Infof(format string, v ...interface{}) {
-	if l.options.Level <= Linfo {
+	if l.core.level.Load() <= int32(Linfo) {
 		l.Output(Linfo, 3, fmt.Sprintf(format, v...))
 	}
 }
@@ -422,7 +1221,7 @@ func (l *Logger) Infof(format string, v ...interface{}) {
 // Info calls l.Output to print to the logger.
 // Arguments are handled in the manner of fmt.Print.
 func (l *Logger) Info(v ...interface{}) {
-	if l.options.Level <= Linfo {
+	if l.core.level.Load() <= int32(Linfo) {
 		l.Output(Linfo, 3, fmt.Sprint(v...))
 	}
 }
@@ -430,15 +1229,24 @@ func (l *Logger) Info(v ...interface{}) {
 // Infoln calls l.Output to print to the logger.
 // Arguments are handled in the manner of fmt.Println.
 func (l *Logger) Infoln(v ...interface{}) {
-	if l.options.Level <= Linfo {
+	if l.core.level.Load() <= int32(Linfo) {
 		l.Output(Linfo, 3, fmt.Sprintln(v...))
 	}
 }
 
+// Infow logs msg and kv (plus any fields from With) as a structured
+// record, encoded per LogOptions.Encoder.
+// Arguments are handled in the manner of With: alternating keys and values.
+func (l *Logger) Infow(msg string, kv ...interface{}) {
+	if l.core.level.Load() <= int32(Linfo) {
+		l.outputw(Linfo, 3, msg, kv)
+	}
+}
+
 // Warnf calls l.Output to print to the logger.
 // Arguments are handled in the manner of fmt.Printf.
 func (l *Logger) Warnf(format string, v ...interface{}) {
-	if l.options.Level <= Lwarn {
+	if l.core.level.Load() <= int32(Lwarn) {
 		l.Output(Lwarn, 3, fmt.Sprintf(format, v...))
 	}
 }
@@ -446,7 +1254,7 @@ func (l *Logger) Warnf(format string, v ...interface{}) {
 // Warn calls l.Output to print to the logger.
 // Arguments are handled in the manner of fmt.Print.
 func (l *Logger) Warn(v ...interface{}) {
-	if l.options.Level <= Lwarn {
+	if l.core.level.Load() <= int32(Lwarn) {
 		l.Output(Lwarn, 3, fmt.Sprint(v...))
 	}
 }
@@ -454,15 +1262,24 @@ func (l *Logger) Warn(v ...interface{}) {
 // Warnln calls l.Output to print to the logger.
 // Arguments are handled in the manner of fmt.Println.
 func (l *Logger) Warnln(v ...interface{}) {
-	if l.options.Level <= Lwarn {
+	if l.core.level.Load() <= int32(Lwarn) {
 		l.Output(Lwarn, 3, fmt.Sprintln(v...))
 	}
 }
 
+// Warnw logs msg and kv (plus any fields from With) as a structured
+// record, encoded per LogOptions.Encoder.
+// Arguments are handled in the manner of With: alternating keys and values.
+func (l *Logger) Warnw(msg string, kv ...interface{}) {
+	if l.core.level.Load() <= int32(Lwarn) {
+		l.outputw(Lwarn, 3, msg, kv)
+	}
+}
+
 // Errorf calls l.Output to print to the logger.
 // Arguments are handled in the manner of fmt.Printf.
 func (l *Logger) Errorf(format string, v ...interface{}) {
-	if l.options.Level <= Lerror {
+	if l.core.level.Load() <= int32(Lerror) {
 		l.Output(Lerror, 3, fmt.Sprintf(format, v...))
 	}
 }
@@ -470,7 +1287,7 @@ func (l *Logger) Errorf(format string, v ...interface{}) {
 // Error calls l.Output to print to the logger.
 // Arguments are handled in the manner of fmt.Print.
 func (l *Logger) Error(v ...interface{}) {
-	if l.options.Level <= Lerror {
+	if l.core.level.Load() <= int32(Lerror) {
 		l.Output(Lerror, 3, fmt.Sprint(v...))
 	}
 }
@@ -478,15 +1295,24 @@ func (l *Logger) Error(v ...interface{}) {
 // Errorln calls l.Output to print to the logger.
 // Arguments are handled in the manner of fmt.Println.
 func (l *Logger) Errorln(v ...interface{}) {
-	if l.options.Level <= Lerror {
+	if l.core.level.Load() <= int32(Lerror) {
 		l.Output(Lerror, 3, fmt.Sprintln(v...))
 	}
 }
 
+// Errorw logs msg and kv (plus any fields from With) as a structured
+// record, encoded per LogOptions.Encoder.
+// Arguments are handled in the manner of With: alternating keys and values.
+func (l *Logger) Errorw(msg string, kv ...interface{}) {
+	if l.core.level.Load() <= int32(Lerror) {
+		l.outputw(Lerror, 3, msg, kv)
+	}
+}
+
 // Fatalf calls l.Output to print to the logger.
 // Arguments are handled in the manner of fmt.Printf.
 func (l *Logger) Fatalf(format string, v ...interface{}) {
-	if l.options.Level <= Lfatal {
+	if l.core.level.Load() <= int32(Lfatal) {
 		l.Output(Lfatal, 3, fmt.Sprintf(format, v...))
 	}
 }
@@ -494,7 +1320,7 @@ func (l *Logger) Fatalf(format string, v ...interface{}) {
 // Fatal calls l.Output to print to the logger.
 // Arguments are handled in the manner of fmt.Print.
 func (l *Logger) Fatal(v ...interface{}) {
-	if l.options.Level <= Lfatal {
+	if l.core.level.Load() <= int32(Lfatal) {
 		l.Output(Lfatal, 3, fmt.Sprint(v...))
 	}
 }
@@ -502,7 +1328,397 @@ func (l *Logger) Fatal(v ...interface{}) {
 // Fatalln calls l.Output to print to the logger.
 // Arguments are handled in the manner of fmt.Println.
 func (l *Logger) Fatalln(v ...interface{}) {
-	if l.options.Level <= Lfatal {
+	if l.core.level.Load() <= int32(Lfatal) {
 		l.Output(Lfatal, 3, fmt.Sprintln(v...))
 	}
 }
+
+// appendLogfmtFields appends fields to buf as " key=value" pairs, used to
+// tack With's structured context onto an otherwise free-form text record.
+func appendLogfmtFields(buf []byte, fields []field) []byte {
+	for _, f := range fields {
+		buf = append(buf, ' ')
+		buf = append(buf, f.key...)
+		buf = append(buf, '=')
+		buf = appendLogfmtValue(buf, f.val)
+	}
+	return buf
+}
+
+// appendJSONRecord appends msg and fields as a single JSON object followed
+// by a newline. ts, level and caller are included only when the
+// corresponding flag bits (Ldate/Ltime/Lmicroseconds, Llevel, Lshortfile/
+// Llongfile) are set.
+func appendJSONRecord(buf []byte, flag int, level Level, t time.Time, caller, msg string, fields []field) []byte {
+	buf = append(buf, '{')
+	n := 0
+	if flag&(Ldate|Ltime|Lmicroseconds) != 0 {
+		buf = appendJSONKV(buf, n > 0, "ts", formatTimestamp(flag, t))
+		n++
+	}
+	if flag&Llevel != 0 {
+		buf = appendJSONKV(buf, n > 0, "level", levelName[level])
+		n++
+	}
+	if caller != "" {
+		buf = appendJSONKV(buf, n > 0, "caller", caller)
+		n++
+	}
+	buf = appendJSONKV(buf, n > 0, "msg", msg)
+
+	for _, f := range fields {
+		buf = append(buf, ',')
+		buf = appendJSONString(buf, f.key)
+		buf = append(buf, ':')
+		buf = appendJSONValue(buf, f.val)
+	}
+	buf = append(buf, '}', '\n')
+	return buf
+}
+
+// appendJSONKV appends a "key":"val" pair, preceded by a comma if needComma.
+func appendJSONKV(buf []byte, needComma bool, key, val string) []byte {
+	if needComma {
+		buf = append(buf, ',')
+	}
+	buf = appendJSONString(buf, key)
+	buf = append(buf, ':')
+	buf = appendJSONString(buf, val)
+	return buf
+}
+
+// appendJSONValue appends val as a JSON scalar, type-switching on the
+// common field value types to avoid fmt.Sprintf and falling back to
+// fmt.Sprint for anything else.
+func appendJSONValue(buf []byte, val interface{}) []byte {
+	switch v := val.(type) {
+	case string:
+		return appendJSONString(buf, v)
+	case bool:
+		return strconv.AppendBool(buf, v)
+	case int:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case int32:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case int64:
+		return strconv.AppendInt(buf, v, 10)
+	case uint64:
+		return strconv.AppendUint(buf, v, 10)
+	case float64:
+		return strconv.AppendFloat(buf, v, 'g', -1, 64)
+	case time.Duration:
+		return appendJSONString(buf, v.String())
+	case error:
+		return appendJSONString(buf, v.Error())
+	case nil:
+		return append(buf, "null"...)
+	default:
+		return appendJSONString(buf, fmt.Sprint(v))
+	}
+}
+
+// appendJSONString appends s as a quoted, escaped JSON string.
+func appendJSONString(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf = append(buf, '\\', '"')
+		case '\\':
+			buf = append(buf, '\\', '\\')
+		case '\n':
+			buf = append(buf, '\\', 'n')
+		case '\t':
+			buf = append(buf, '\\', 't')
+		case '\r':
+			buf = append(buf, '\\', 'r')
+		default:
+			if r < 0x20 {
+				buf = append(buf, '\\', 'u', '0', '0', hexDigit(byte(r)>>4), hexDigit(byte(r)&0xf))
+			} else {
+				buf = utf8.AppendRune(buf, r)
+			}
+		}
+	}
+	buf = append(buf, '"')
+	return buf
+}
+
+func hexDigit(b byte) byte {
+	if b < 10 {
+		return '0' + b
+	}
+	return 'a' + b - 10
+}
+
+// appendLogfmtRecord appends msg and fields as logfmt key=value pairs
+// followed by a newline, under the same ts/level/caller flag rules as
+// appendJSONRecord.
+func appendLogfmtRecord(buf []byte, flag int, level Level, t time.Time, caller, msg string, fields []field) []byte {
+	n := 0
+	if flag&(Ldate|Ltime|Lmicroseconds) != 0 {
+		buf = appendLogfmtKV(buf, n > 0, "ts", formatTimestamp(flag, t))
+		n++
+	}
+	if flag&Llevel != 0 {
+		buf = appendLogfmtKV(buf, n > 0, "level", levelName[level])
+		n++
+	}
+	if caller != "" {
+		buf = appendLogfmtKV(buf, n > 0, "caller", caller)
+		n++
+	}
+	buf = appendLogfmtKV(buf, n > 0, "msg", msg)
+
+	for _, f := range fields {
+		buf = append(buf, ' ')
+		buf = append(buf, f.key...)
+		buf = append(buf, '=')
+		buf = appendLogfmtValue(buf, f.val)
+	}
+	buf = append(buf, '\n')
+	return buf
+}
+
+// appendLogfmtKV appends a key=value pair, preceded by a space if needSpace.
+func appendLogfmtKV(buf []byte, needSpace bool, key, val string) []byte {
+	if needSpace {
+		buf = append(buf, ' ')
+	}
+	buf = append(buf, key...)
+	buf = append(buf, '=')
+	return appendLogfmtValue(buf, val)
+}
+
+// appendLogfmtValue appends val as a logfmt value, type-switching on the
+// common field value types to avoid fmt.Sprintf and falling back to
+// fmt.Sprint for anything else.
+func appendLogfmtValue(buf []byte, val interface{}) []byte {
+	switch v := val.(type) {
+	case string:
+		return appendLogfmtString(buf, v)
+	case bool:
+		return strconv.AppendBool(buf, v)
+	case int:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case int32:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case int64:
+		return strconv.AppendInt(buf, v, 10)
+	case uint64:
+		return strconv.AppendUint(buf, v, 10)
+	case float64:
+		return strconv.AppendFloat(buf, v, 'g', -1, 64)
+	case time.Duration:
+		return appendLogfmtString(buf, v.String())
+	case error:
+		return appendLogfmtString(buf, v.Error())
+	case nil:
+		return append(buf, '-')
+	default:
+		return appendLogfmtString(buf, fmt.Sprint(v))
+	}
+}
+
+// appendLogfmtString appends s bare if it needs no quoting, or as a quoted,
+// escaped logfmt string otherwise.
+func appendLogfmtString(buf []byte, s string) []byte {
+	if !needsLogfmtQuoting(s) {
+		return append(buf, s...)
+	}
+	buf = append(buf, '"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf = append(buf, '\\', '"')
+		case '\\':
+			buf = append(buf, '\\', '\\')
+		case '\n':
+			buf = append(buf, '\\', 'n')
+		default:
+			buf = utf8.AppendRune(buf, r)
+		}
+	}
+	buf = append(buf, '"')
+	return buf
+}
+
+// needsLogfmtQuoting reports whether s requires quoting to be an
+// unambiguous logfmt value: empty, or containing whitespace, '=' or '"'.
+func needsLogfmtQuoting(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '=' || r == '"' {
+			return true
+		}
+	}
+	return false
+}
+
+// formatTimestamp renders t as RFC3339Nano for structured (JSON/logfmt)
+// records, honoring LUTC the same way appendTextRecord does for text records.
+func formatTimestamp(flag int, t time.Time) string {
+	if flag&LUTC != 0 {
+		t = t.UTC()
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// VLevel is the verbosity level consulted by V. Unlike Level (which picks
+// DEBUG/INFO/WARN/... severity), VLevel is an open-ended integer scale: the
+// higher the level passed to V, the more verbose/rare the call site, mirroring
+// klog/glog's -v and -vmodule flags.
+type VLevel int32
+
+// modulePat is one parsed entry of a SetVModule spec: a glob pattern matched
+// against the caller's source file, and the VLevel threshold for matches.
+type modulePat struct {
+	pattern string
+	level   VLevel
+}
+
+// Verbose is returned by V and records whether the call site's verbosity
+// threshold has been met. Its methods are no-ops when enabled is false, so
+// the common case of a disabled V(n) call costs one bool check.
+type Verbose struct {
+	enabled bool
+	logger  *Logger
+}
+
+// SetVerbosity sets the global V() threshold: a call to V(level) is enabled
+// when level <= v, unless a more specific SetVModule pattern overrides it
+// for the caller's file.
+func (l *Logger) SetVerbosity(v int32) {
+	atomic.StoreInt32(&l.core.verbosity, v)
+	l.core.vcache.Store(&sync.Map{})
+}
+
+// SetVModule parses a comma-separated list of pattern=level entries, e.g.
+// "file1=2,file2=3,pkg/*=1", and installs them as per-file overrides for V().
+// pattern is matched, via path/filepath glob rules, against the trailing
+// path segments of the caller's source file with the ".go" suffix removed;
+// a pattern with N slashes is matched against the file's last N+1 segments,
+// so "pkg/*" matches any file under a directory named pkg while "worker"
+// matches only a file named worker.go regardless of its directory. The most
+// recently installed spec replaces any previous one, and the PC cache used
+// by V is invalidated so new thresholds take effect immediately.
+func (l *Logger) SetVModule(spec string) error {
+	var pats []modulePat
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		eq := strings.LastIndex(entry, "=")
+		if eq < 0 {
+			return fmt.Errorf("glog: malformed vmodule entry %q", entry)
+		}
+		pattern, levelStr := entry[:eq], entry[eq+1:]
+		v, err := strconv.Atoi(levelStr)
+		if err != nil {
+			return fmt.Errorf("glog: malformed vmodule level in %q: %v", entry, err)
+		}
+		pats = append(pats, modulePat{pattern: pattern, level: VLevel(v)})
+	}
+
+	c := l.core
+	c.vmoduleMu.Lock()
+	c.vmodule = pats
+	c.vmoduleMu.Unlock()
+	c.vcache.Store(&sync.Map{})
+	return nil
+}
+
+// V reports whether verbosity level level is enabled for the caller, consulting
+// any SetVModule override for the caller's file before falling back to the
+// global SetVerbosity threshold. The threshold is cached by call-site PC so
+// that repeated V(n) calls skip pattern matching and cost a runtime.Caller
+// call, an atomic load and a map lookup.
+func (l *Logger) V(level VLevel) Verbose {
+	pc, _, _, ok := runtime.Caller(1)
+	if !ok {
+		return Verbose{enabled: level <= VLevel(atomic.LoadInt32(&l.core.verbosity)), logger: l}
+	}
+
+	vcache := l.core.vcache.Load()
+	if cached, ok := vcache.Load(pc); ok {
+		return Verbose{enabled: level <= cached.(VLevel), logger: l}
+	}
+
+	threshold := l.vmoduleThreshold(pc)
+	vcache.Store(pc, threshold)
+	return Verbose{enabled: level <= threshold, logger: l}
+}
+
+// vmoduleThreshold returns the VLevel that applies to the call site at pc:
+// the level of the first matching SetVModule pattern, or the global
+// verbosity if none match.
+func (l *Logger) vmoduleThreshold(pc uintptr) VLevel {
+	c := l.core
+	c.vmoduleMu.RLock()
+	pats := c.vmodule
+	c.vmoduleMu.RUnlock()
+
+	if len(pats) > 0 {
+		if file, _ := callerFile(pc); file != "" {
+			for _, p := range pats {
+				if matchModule(p.pattern, file) {
+					return p.level
+				}
+			}
+		}
+	}
+	return VLevel(atomic.LoadInt32(&c.verbosity))
+}
+
+// callerFile returns the source file and line for pc, as reported by the runtime.
+func callerFile(pc uintptr) (file string, line int) {
+	fn := runtime.FuncForPC(pc)
+	if fn == nil {
+		return "", 0
+	}
+	return fn.FileLine(pc)
+}
+
+// matchModule reports whether file matches pattern as SetVModule would: the
+// ".go" suffix is stripped, and pattern is matched against the last
+// 1+strings.Count(pattern, "/") slash-separated segments of file.
+func matchModule(pattern, file string) bool {
+	file = strings.TrimSuffix(filepath.ToSlash(file), ".go")
+	segs := strings.Split(file, "/")
+
+	n := strings.Count(pattern, "/") + 1
+	if n > len(segs) {
+		return false
+	}
+	candidate := strings.Join(segs[len(segs)-n:], "/")
+
+	matched, _ := filepath.Match(pattern, candidate)
+	return matched
+}
+
+// Info calls l.Output to print to the logger, if V reported this call site enabled.
+// Arguments are handled in the manner of fmt.Print.
+func (v Verbose) Info(args ...interface{}) {
+	if v.enabled {
+		v.logger.Output(Linfo, 3, fmt.Sprint(args...))
+	}
+}
+
+// Infof calls l.Output to print to the logger, if V reported this call site enabled.
+// Arguments are handled in the manner of fmt.Printf.
+func (v Verbose) Infof(format string, args ...interface{}) {
+	if v.enabled {
+		v.logger.Output(Linfo, 3, fmt.Sprintf(format, args...))
+	}
+}
+
+// Infoln calls l.Output to print to the logger, if V reported this call site enabled.
+// Arguments are handled in the manner of fmt.Println.
+func (v Verbose) Infoln(args ...interface{}) {
+	if v.enabled {
+		v.logger.Output(Linfo, 3, fmt.Sprintln(args...))
+	}
+}